@@ -8,10 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-ipfs/blocks/blockstore"
 	exchange "github.com/ipfs/go-ipfs/exchange"
-	bitswap "github.com/ipfs/go-ipfs/exchange/bitswap"
 
 	logging "gx/ipfs/QmSpJByNKFX1sCsHBEp3R73FL4NF6FnQTEGyNAXHm2GS52/go-log"
 	cid "gx/ipfs/QmcZfnkapfECQGcLZaf9B79NRg7cRa9EnZh4LSbkCzwNvY/go-cid"
@@ -22,6 +23,31 @@ var log = logging.Logger("blockservice")
 
 var ErrNotFound = errors.New("blockservice: key not found")
 
+// ErrCIDMismatch is returned when a block's content does not hash to the
+// CID it was stored or fetched under, i.e. the block has been corrupted or
+// tampered with.
+type ErrCIDMismatch struct {
+	Expected *cid.Cid
+	Got      *cid.Cid
+}
+
+func (e ErrCIDMismatch) Error() string {
+	return fmt.Sprintf("blockservice: block content does not match CID: expected %s, got %s", e.Expected, e.Got)
+}
+
+// verifyBlock recomputes b's multihash from its raw bytes against c's
+// prefix and reports ErrCIDMismatch if it doesn't match c.
+func verifyBlock(b blocks.Block, c *cid.Cid) error {
+	computed, err := c.Prefix().Sum(b.RawData())
+	if err != nil {
+		return err
+	}
+	if !computed.Equals(c) {
+		return ErrCIDMismatch{Expected: c, Got: computed}
+	}
+	return nil
+}
+
 // BlockGetter is the common interface shared between blockservice sessions and
 // the blockservice.
 type BlockGetter interface {
@@ -54,12 +80,33 @@ type BlockService interface {
 	// AddBlock puts a given block to the underlying datastore
 	AddBlock(o blocks.Block) error
 
+	// AddBlockCtx is the context-aware equivalent of AddBlock. ctx is
+	// checked before the block is stored and again before it is announced
+	// on the exchange; an announcement that is already under way is not
+	// interrupted, since exchange.HasBlock takes no context.
+	AddBlockCtx(ctx context.Context, o blocks.Block) error
+
 	// AddBlocks adds a slice of blocks at the same time using batching
 	// capabilities of the underlying datastore whenever possible.
 	AddBlocks(bs []blocks.Block) error
 
+	// AddBlocksCtx is the context-aware equivalent of AddBlocks.
+	AddBlocksCtx(ctx context.Context, bs []blocks.Block) error
+
 	// DeleteBlock deletes the given block from the blockservice.
 	DeleteBlock(o *cid.Cid) error
+
+	// DeleteBlocks deletes the given blocks from the blockservice in one
+	// call. If any delete fails, it returns a slice with one entry per input
+	// cid (in the same order as cids), holding that cid's error or nil if it
+	// was deleted. A nil slice means every delete succeeded.
+	//
+	// blockstore.Blockstore has no batch-delete primitive at this vintage,
+	// so this deletes cids one at a time rather than in a single
+	// blockstore transaction; it exists to give callers one call site and
+	// one aggregated error result instead of looping DeleteBlock
+	// themselves.
+	DeleteBlocks(ctx context.Context, cids []*cid.Cid) []error
 }
 
 type blockService struct {
@@ -68,33 +115,86 @@ type blockService struct {
 	// If checkFirst is true then first check that a block doesn't
 	// already exist to avoid republishing the block on the exchange.
 	checkFirst bool
+	// If verifyOnAdd is true, AddBlock/AddBlocks recompute each block's
+	// multihash from its bytes and reject it if it doesn't match the
+	// declared CID.
+	verifyOnAdd bool
+	// If verifyOnGet is true, GetBlock recomputes a retrieved block's
+	// multihash and self-heals by deleting and refetching on mismatch.
+	verifyOnGet bool
+	// metrics receives instrumentation events; defaults to a no-op.
+	metrics Metrics
+}
+
+// Option configures optional behavior on a BlockService created by New or
+// NewWriteThrough.
+type Option func(*blockService)
+
+// WithVerifyOnAdd enables verifying, on AddBlock/AddBlocks, that a block's
+// content actually hashes to its declared CID before it is stored. Mismatches
+// are reported as ErrCIDMismatch.
+func WithVerifyOnAdd(verify bool) Option {
+	return func(s *blockService) {
+		s.verifyOnAdd = verify
+	}
+}
+
+// WithVerifyOnGet enables verifying, on GetBlock, that a retrieved block's
+// content actually hashes to the CID it was fetched for. A local blockstore
+// hit that fails verification is deleted and refetched through the exchange
+// so a corrupted cache entry self-heals instead of poisoning downstream DAG
+// traversal; a mismatch from the exchange itself is returned as
+// ErrCIDMismatch.
+func WithVerifyOnGet(verify bool) Option {
+	return func(s *blockService) {
+		s.verifyOnGet = verify
+	}
+}
+
+// WithMetrics sets the Metrics implementation that the BlockService and any
+// Sessions derived from it report to. Without this option, events are
+// dropped.
+func WithMetrics(m Metrics) Option {
+	return func(s *blockService) {
+		s.metrics = m
+	}
 }
 
 // NewBlockService creates a BlockService with given datastore instance.
-func New(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+func New(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		log.Warning("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
+	s := &blockService{
 		blockstore: bs,
 		exchange:   rem,
 		checkFirst: true,
+		metrics:    defaultMetrics,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // NewWriteThrough ceates a BlockService that guarantees writes will go
 // through to the blockstore and are not skipped by cache checks.
-func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		log.Warning("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
+	s := &blockService{
 		blockstore: bs,
 		exchange:   rem,
 		checkFirst: false,
+		metrics:    defaultMetrics,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Blockstore returns the blockstore behind this blockservice.
@@ -107,29 +207,81 @@ func (s *blockService) Exchange() exchange.Interface {
 	return s.exchange
 }
 
-// NewSession creates a bitswap session that allows for controlled exchange of
+// sessionExchange is satisfied by any exchange.Interface that can hand out
+// its own bitswap-style sessions, whether that's *bitswap.Bitswap itself or
+// a composite exchange (see exchange.NewMulti) that builds a session-scoped
+// composite over all of its members.
+type sessionExchange interface {
+	NewSession(ctx context.Context) exchange.Fetcher
+}
+
+// sessionIDCounter hands out unique, process-local ids for Sessions so a
+// SessionMetrics can distinguish their cumulative byte counts.
+var sessionIDCounter uint64
+
+// NewSession creates a session that allows for controlled exchange of
 // wantlists to decrease the bandwidth overhead.
 func NewSession(ctx context.Context, bs BlockService) *Session {
-	exchange := bs.Exchange()
-	if bswap, ok := exchange.(*bitswap.Bitswap); ok {
-		ses := bswap.NewSession(ctx)
+	ex := bs.Exchange()
+
+	var verifyOnGet bool
+	metrics := defaultMetrics
+	if s, ok := bs.(*blockService); ok {
+		verifyOnGet = s.verifyOnGet
+		metrics = s.metrics
+	}
+
+	id := atomic.AddUint64(&sessionIDCounter, 1)
+
+	if se, ok := ex.(sessionExchange); ok {
 		return &Session{
-			ses: ses,
-			bs:  bs.Blockstore(),
+			ses:         se.NewSession(ctx),
+			bs:          bs.Blockstore(),
+			verifyOnGet: verifyOnGet,
+			metrics:     metrics,
+			id:          id,
 		}
 	}
 	return &Session{
-		ses: exchange,
-		bs:  bs.Blockstore(),
+		ses:         ex,
+		bs:          bs.Blockstore(),
+		verifyOnGet: verifyOnGet,
+		metrics:     metrics,
+		id:          id,
 	}
 }
 
 // AddBlock adds a particular block to the service, Putting it into the datastore.
-// TODO pass a context into this if the remote.HasBlock is going to remain here.
+//
+// Deprecated: use AddBlockCtx instead.
 func (s *blockService) AddBlock(o blocks.Block) error {
+	return s.AddBlockCtx(context.Background(), o)
+}
+
+// AddBlockCtx puts a given block to the underlying datastore and announces
+// it on the exchange, honoring ctx cancellation while doing so.
+//
+// TODO(#4623): exchange.HasBlock itself doesn't yet accept a context, so
+// cancellation is only checked around it, not threaded all the way down into
+// bitswap. Once exchange.Interface grows a context-aware HasBlock, thread
+// ctx through to it directly.
+func (s *blockService) AddBlockCtx(ctx context.Context, o blocks.Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	c := o.Cid()
+	if s.verifyOnAdd {
+		if err := verifyBlock(o, c); err != nil {
+			return err
+		}
+	}
+
 	if s.checkFirst {
 		if has, err := s.blockstore.Has(c); has || err != nil {
+			if has {
+				s.metrics.OnAdd(c, len(o.RawData()), true)
+			}
 			return err
 		}
 	}
@@ -138,15 +290,41 @@ func (s *blockService) AddBlock(o blocks.Block) error {
 		return err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if err := s.exchange.HasBlock(o); err != nil {
 		// TODO(#4623): really an error?
 		return errors.New("blockservice is closed")
 	}
 
+	s.metrics.OnAdd(c, len(o.RawData()), false)
 	return nil
 }
 
+// AddBlocks adds a slice of blocks at the same time using batching
+// capabilities of the underlying datastore whenever possible.
+//
+// Deprecated: use AddBlocksCtx instead.
 func (s *blockService) AddBlocks(bs []blocks.Block) error {
+	return s.AddBlocksCtx(context.Background(), bs)
+}
+
+// AddBlocksCtx is the context-aware equivalent of AddBlocks.
+func (s *blockService) AddBlocksCtx(ctx context.Context, bs []blocks.Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.verifyOnAdd {
+		for _, b := range bs {
+			if err := verifyBlock(b, b.Cid()); err != nil {
+				return err
+			}
+		}
+	}
+
 	var toput []blocks.Block
 	if s.checkFirst {
 		toput = make([]blocks.Block, 0, len(bs))
@@ -155,9 +333,11 @@ func (s *blockService) AddBlocks(bs []blocks.Block) error {
 			if err != nil {
 				return err
 			}
-			if !has {
-				toput = append(toput, b)
+			if has {
+				s.metrics.OnAdd(b.Cid(), len(b.RawData()), true)
+				continue
 			}
+			toput = append(toput, b)
 		}
 	} else {
 		toput = bs
@@ -169,10 +349,14 @@ func (s *blockService) AddBlocks(bs []blocks.Block) error {
 	}
 
 	for _, o := range toput {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := s.exchange.HasBlock(o); err != nil {
 			// TODO(#4623): Should this really *return*?
 			return fmt.Errorf("blockservice is closed (%s)", err)
 		}
+		s.metrics.OnAdd(o.Cid(), len(o.RawData()), false)
 	}
 	return nil
 }
@@ -187,27 +371,28 @@ func (s *blockService) GetBlock(ctx context.Context, c *cid.Cid) (blocks.Block,
 		f = s.exchange
 	}
 
-	return getBlock(ctx, c, s.blockstore, f)
+	return getBlock(ctx, c, s.blockstore, f, s.verifyOnGet, s.metrics)
 }
 
-func getBlock(ctx context.Context, c *cid.Cid, bs blockstore.Blockstore, f exchange.Fetcher) (blocks.Block, error) {
+func getBlock(ctx context.Context, c *cid.Cid, bs blockstore.Blockstore, f exchange.Fetcher, verifyOnGet bool, m Metrics) (blocks.Block, error) {
 	block, err := bs.Get(c)
 	if err == nil {
+		if verifyOnGet {
+			if verr := verifyBlock(block, c); verr != nil {
+				log.Errorf("local block for %s failed verification (%s); evicting corrupt cache entry", c, verr)
+				if delErr := bs.DeleteBlock(c); delErr != nil {
+					log.Errorf("failed to evict corrupt block %s: %s", c, delErr)
+				}
+				return fetchFromExchange(ctx, c, f, verifyOnGet, m)
+			}
+		}
+		m.OnGetHit(c, len(block.RawData()))
 		return block, nil
 	}
 
 	if err == blockstore.ErrNotFound && f != nil {
-		// TODO be careful checking ErrNotFound. If the underlying
-		// implementation changes, this will break.
-		log.Debug("Blockservice: Searching bitswap")
-		blk, err := f.GetBlock(ctx, c)
-		if err != nil {
-			if err == blockstore.ErrNotFound {
-				return nil, ErrNotFound
-			}
-			return nil, err
-		}
-		return blk, nil
+		m.OnGetMiss(c)
+		return fetchFromExchange(ctx, c, f, verifyOnGet, m)
 	}
 
 	log.Debug("Blockservice GetBlock: Not found")
@@ -218,10 +403,40 @@ func getBlock(ctx context.Context, c *cid.Cid, bs blockstore.Blockstore, f excha
 	return nil, err
 }
 
+// fetchFromExchange fetches c from f, optionally verifying the result
+// against c before returning it.
+func fetchFromExchange(ctx context.Context, c *cid.Cid, f exchange.Fetcher, verifyOnGet bool, m Metrics) (blocks.Block, error) {
+	if f == nil {
+		return nil, ErrNotFound
+	}
+
+	// TODO be careful checking ErrNotFound. If the underlying
+	// implementation changes, this will break.
+	log.Debug("Blockservice: Searching bitswap")
+	start := time.Now()
+	blk, err := f.GetBlock(ctx, c)
+	m.OnExchangeFetch(c, time.Since(start), err)
+	if err != nil {
+		if err == blockstore.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	if verifyOnGet {
+		if verr := verifyBlock(blk, c); verr != nil {
+			return nil, verr
+		}
+	}
+	return blk, nil
+}
+
 // GetBlocks gets a list of blocks asynchronously and returns through
 // the returned channel.
 // NB: No guarantees are made about order.
 func (s *blockService) GetBlocks(ctx context.Context, ks []*cid.Cid) <-chan blocks.Block {
+	// NB: batch fetches don't verify; WithVerifyOnGet only covers the
+	// single-block GetBlock path for now.
 	return getBlocks(ctx, ks, s.blockstore, s.exchange)
 }
 
@@ -267,7 +482,41 @@ func getBlocks(ctx context.Context, ks []*cid.Cid, bs blockstore.Blockstore, f e
 
 // DeleteBlock deletes a block in the blockservice from the datastore
 func (s *blockService) DeleteBlock(c *cid.Cid) error {
-	return s.blockstore.DeleteBlock(c)
+	if err := s.blockstore.DeleteBlock(c); err != nil {
+		return err
+	}
+	s.metrics.OnDelete(c)
+	return nil
+}
+
+// DeleteBlocks deletes the given cids from the blockservice's blockstore,
+// one at a time (the underlying blockstore.Blockstore has no batch-delete
+// primitive to hand this off to), returning one error per cid that failed
+// to delete (nil for cids that were removed successfully). The returned
+// slice is nil if every delete succeeded.
+func (s *blockService) DeleteBlocks(ctx context.Context, cids []*cid.Cid) []error {
+	var errs []error
+	for i, c := range cids {
+		if err := ctx.Err(); err != nil {
+			if errs == nil {
+				errs = make([]error, len(cids))
+			}
+			for j := i; j < len(cids); j++ {
+				errs[j] = err
+			}
+			break
+		}
+
+		if err := s.blockstore.DeleteBlock(c); err != nil {
+			if errs == nil {
+				errs = make([]error, len(cids))
+			}
+			errs[i] = err
+			continue
+		}
+		s.metrics.OnDelete(c)
+	}
+	return errs
 }
 
 func (s *blockService) Close() error {
@@ -277,18 +526,48 @@ func (s *blockService) Close() error {
 
 // Session is a helper type to provide higher level access to bitswap sessions
 type Session struct {
-	bs  blockstore.Blockstore
-	ses exchange.Fetcher
+	bs           blockstore.Blockstore
+	ses          exchange.Fetcher
+	verifyOnGet  bool
+	metrics      Metrics
+	id           uint64
+	bytesFetched uint64 // accessed atomically
 }
 
 // GetBlock gets a block in the context of a request session
 func (s *Session) GetBlock(ctx context.Context, c *cid.Cid) (blocks.Block, error) {
-	return getBlock(ctx, c, s.bs, s.ses)
+	blk, err := getBlock(ctx, c, s.bs, s.ses, s.verifyOnGet, s.metrics)
+	if err == nil {
+		s.reportBytes(len(blk.RawData()))
+	}
+	return blk, err
 }
 
 // GetBlocks gets blocks in the context of a request session
 func (s *Session) GetBlocks(ctx context.Context, ks []*cid.Cid) <-chan blocks.Block {
-	return getBlocks(ctx, ks, s.bs, s.ses)
+	in := getBlocks(ctx, ks, s.bs, s.ses)
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for b := range in {
+			s.reportBytes(len(b.RawData()))
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// reportBytes adds n to the session's cumulative fetched-byte count and, if
+// the session's Metrics supports it, reports the running total.
+func (s *Session) reportBytes(n int) {
+	total := atomic.AddUint64(&s.bytesFetched, uint64(n))
+	if sm, ok := s.metrics.(SessionMetrics); ok {
+		sm.OnSessionBytes(s.id, total)
+	}
 }
 
 var _ BlockGetter = (*Session)(nil)
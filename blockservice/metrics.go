@@ -0,0 +1,58 @@
+package blockservice
+
+import (
+	"time"
+
+	cid "gx/ipfs/QmcZfnkapfECQGcLZaf9B79NRg7cRa9EnZh4LSbkCzwNvY/go-cid"
+)
+
+// Metrics receives instrumentation events from a BlockService and its
+// Sessions. Methods are called synchronously on the calling goroutine, so
+// implementations must not block (e.g. when feeding a Prometheus
+// counter/histogram, this is never a problem; anything slower should hop
+// off onto its own goroutine).
+type Metrics interface {
+	// OnGetHit is called when GetBlock finds c in the local blockstore.
+	OnGetHit(c *cid.Cid, size int)
+
+	// OnGetMiss is called when GetBlock doesn't find c locally and falls
+	// back to the exchange.
+	OnGetMiss(c *cid.Cid)
+
+	// OnExchangeFetch is called after a fetch through the exchange
+	// completes, successfully or not.
+	OnExchangeFetch(c *cid.Cid, duration time.Duration, err error)
+
+	// OnAdd is called after AddBlock/AddBlocks processes c, whether or not
+	// it was actually written to the blockstore; deduped is true if c was
+	// already present and the write was skipped.
+	OnAdd(c *cid.Cid, size int, deduped bool)
+
+	// OnDelete is called after DeleteBlock/DeleteBlocks removes c.
+	OnDelete(c *cid.Cid)
+}
+
+// SessionMetrics is an optional extension of Metrics that a Session reports
+// to in addition to the regular per-cid events, giving each session's
+// cumulative bytes fetched so far. This is useful for diagnosing bitswap
+// wantlist behavior when many concurrent sessions are active.
+type SessionMetrics interface {
+	Metrics
+
+	// OnSessionBytes is called each time a Session GetBlock/GetBlocks
+	// obtains a block (for GetBlocks, before the block is sent to the
+	// caller), reporting that session's cumulative bytes fetched so far.
+	OnSessionBytes(sessionID uint64, cumulative uint64)
+}
+
+// nopMetrics is the default Metrics used when none is supplied via
+// WithMetrics.
+type nopMetrics struct{}
+
+func (nopMetrics) OnGetHit(*cid.Cid, int)                         {}
+func (nopMetrics) OnGetMiss(*cid.Cid)                             {}
+func (nopMetrics) OnExchangeFetch(*cid.Cid, time.Duration, error) {}
+func (nopMetrics) OnAdd(*cid.Cid, int, bool)                      {}
+func (nopMetrics) OnDelete(*cid.Cid)                              {}
+
+var defaultMetrics Metrics = nopMetrics{}
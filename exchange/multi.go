@@ -0,0 +1,278 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	cid "gx/ipfs/QmcZfnkapfECQGcLZaf9B79NRg7cRa9EnZh4LSbkCzwNvY/go-cid"
+	blocks "gx/ipfs/Qmej7nf81hi2x2tvjRBF3mcp74sQyuDH4VMYDGd1YtXjb2/go-block-format"
+)
+
+// Policy controls how a Multi exchange fans a GetBlock/GetBlocks request out
+// across its member providers.
+type Policy interface {
+	isPolicy()
+}
+
+type sequentialPolicy struct{}
+
+// PolicySequential tries each provider in order, only moving on to the next
+// once the previous one has returned; if ctx is canceled it stops and
+// returns ctx.Err() without trying the remaining providers.
+// This is the cheapest policy on bandwidth but the slowest to recover from a
+// stalled provider.
+var PolicySequential Policy = sequentialPolicy{}
+
+// PolicyHedged tries providers in order, but if the current one hasn't
+// answered within After, the next provider is started alongside it. The
+// first successful response wins; the rest are discarded.
+type PolicyHedged struct {
+	After time.Duration
+}
+
+func (PolicyHedged) isPolicy() {}
+
+type parallelPolicy struct{}
+
+// PolicyParallel starts every provider at once and takes whichever responds
+// successfully first. Uses the most bandwidth but gives the lowest latency against a
+// cold/unreliable primary.
+var PolicyParallel Policy = parallelPolicy{}
+
+func (sequentialPolicy) isPolicy() {}
+func (parallelPolicy) isPolicy()   {}
+
+// Multi is a composite exchange.Interface that layers a primary exchange
+// (typically bitswap) with one or more fallback exchanges (an HTTP gateway
+// fetcher, graphsync, a LAN-only exchange, etc). GetBlock/GetBlocks consult
+// the members according to Policy; HasBlock is always announced to every
+// member, with errors aggregated rather than short-circuited on the first
+// failure.
+type Multi struct {
+	members []Interface
+	policy  Policy
+}
+
+// NewMulti builds a Multi exchange from a primary provider and any number of
+// fallbacks, combined according to policy. If policy is nil, PolicySequential
+// is used.
+func NewMulti(primary Interface, policy Policy, fallbacks ...Interface) *Multi {
+	if policy == nil {
+		policy = PolicySequential
+	}
+	members := make([]Interface, 0, len(fallbacks)+1)
+	members = append(members, primary)
+	members = append(members, fallbacks...)
+	return &Multi{
+		members: members,
+		policy:  policy,
+	}
+}
+
+// NewSession returns a Fetcher that applies the same member/policy
+// composition as m to a scoped session, so batch fetches through a session
+// don't serialize on a slow primary either.
+func (m *Multi) NewSession(ctx context.Context) Fetcher {
+	sessions := make([]Interface, len(m.members))
+	for i, mem := range m.members {
+		if se, ok := mem.(interface {
+			NewSession(context.Context) Fetcher
+		}); ok {
+			sessions[i] = fetcherOnly{se.NewSession(ctx)}
+			continue
+		}
+		sessions[i] = mem
+	}
+	return &Multi{members: sessions, policy: m.policy}
+}
+
+// fetcherOnly adapts a bare Fetcher (such as a bitswap session) to the
+// Interface-shaped slot used internally by Multi; only GetBlock/GetBlocks
+// are ever called on it.
+type fetcherOnly struct {
+	Fetcher
+}
+
+func (fetcherOnly) HasBlock(blocks.Block) error { return nil }
+func (fetcherOnly) IsOnline() bool              { return true }
+func (fetcherOnly) Close() error                { return nil }
+
+// GetBlock fetches c from the member providers per m's policy.
+func (m *Multi) GetBlock(ctx context.Context, c *cid.Cid) (blocks.Block, error) {
+	switch p := m.policy.(type) {
+	case sequentialPolicy:
+		return m.getBlockSequential(ctx, c)
+	case parallelPolicy:
+		return m.getBlockRaced(ctx, c, 0)
+	case PolicyHedged:
+		return m.getBlockRaced(ctx, c, p.After)
+	default:
+		return m.getBlockSequential(ctx, c)
+	}
+}
+
+func (m *Multi) getBlockSequential(ctx context.Context, c *cid.Cid) (blocks.Block, error) {
+	var lastErr error
+	for _, mem := range m.members {
+		blk, err := mem.GetBlock(ctx, c)
+		if err == nil {
+			return blk, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// getBlockRaced fetches c from the member providers, racing them per delay:
+// delay == 0 starts every member immediately (PolicyParallel); delay > 0
+// starts only the first member and only starts the next one if delay
+// elapses without a result (PolicyHedged), so a fast primary short-circuits
+// before any fallback is ever launched. Either way, the first successful
+// response wins.
+func (m *Multi) getBlockRaced(ctx context.Context, c *cid.Cid, delay time.Duration) (blocks.Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		blk blocks.Block
+		err error
+	}
+	results := make(chan result, len(m.members))
+	launch := func(mem Interface) {
+		go func() {
+			blk, err := mem.GetBlock(ctx, c)
+			results <- result{blk, err}
+		}()
+	}
+
+	next := 0
+	if len(m.members) > 0 {
+		launch(m.members[next])
+		next++
+	}
+	if delay <= 0 {
+		// No staggering: start every remaining member right away.
+		for ; next < len(m.members); next++ {
+			launch(m.members[next])
+		}
+	}
+
+	var lastErr error
+	for remaining := len(m.members); remaining > 0; {
+		if next < len(m.members) {
+			select {
+			case r := <-results:
+				remaining--
+				if r.err == nil {
+					return r.blk, nil
+				}
+				lastErr = r.err
+			case <-time.After(delay):
+				launch(m.members[next])
+				next++
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case r := <-results:
+			remaining--
+			if r.err == nil {
+				return r.blk, nil
+			}
+			lastErr = r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("multi exchange: no provider returned block %s", c)
+	}
+	return nil, lastErr
+}
+
+// GetBlocks fetches ks from the member providers per m's policy, merging
+// their results into a single output channel. Cross-provider duplicates
+// (the same cid answered by two members) never reach here: GetBlock
+// already resolves each cid to a single winning block before GetBlocks sees
+// it. delivered only guards against ks itself listing the same cid more
+// than once.
+func (m *Multi) GetBlocks(ctx context.Context, ks []*cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		var delivered sync.Map // map[string]struct{}, guards against duplicate cids in ks
+		var wg sync.WaitGroup
+		for _, k := range ks {
+			k := k
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				blk, err := m.GetBlock(ctx, k)
+				if err != nil {
+					return
+				}
+				if _, dup := delivered.LoadOrStore(k.KeyString(), struct{}{}); dup {
+					return
+				}
+				select {
+				case out <- blk:
+				case <-ctx.Done():
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+	return out, nil
+}
+
+// HasBlock announces o to every member, aggregating errors instead of
+// returning on the first failure so one down provider doesn't mask
+// announcements to the others.
+func (m *Multi) HasBlock(o blocks.Block) error {
+	var errs []error
+	for _, mem := range m.members {
+		if err := mem.HasBlock(o); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("multi exchange: %d of %d providers failed to announce %s: %v",
+		len(errs), len(m.members), o.Cid(), errs)
+}
+
+// IsOnline reports whether any member is online.
+func (m *Multi) IsOnline() bool {
+	for _, mem := range m.members {
+		if mem.IsOnline() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes every member, aggregating errors the same way HasBlock does.
+func (m *Multi) Close() error {
+	var errs []error
+	for _, mem := range m.members {
+		if err := mem.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("multi exchange: %d of %d providers failed to close: %v",
+		len(errs), len(m.members), errs)
+}
+
+var _ Interface = (*Multi)(nil)